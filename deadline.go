@@ -0,0 +1,41 @@
+package main
+
+// This file bounds how long a single request may spend on store
+// operations, so a hung Datastore call can't tie up the free-tier
+// request quota forever.
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RequestTimeout is how long GetChampion, BeatChampion and
+// RenameChampion may spend on store operations, configurable via
+// SUBLEERUNKER_TIMEOUT (seconds).
+var RequestTimeout = envTimeout("SUBLEERUNKER_TIMEOUT", 10*time.Second)
+
+// envTimeout reads a duration in seconds from the named environment
+// variable, falling back to def if it's unset or unparsable.
+func envTimeout(key string, def time.Duration) time.Duration {
+	s := os.Getenv(key)
+	if s == "" {
+		return def
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || seconds <= 0 {
+		return def
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// WithDeadline derives a context bounded by both the inbound request's
+// own cancellation (client disconnect, platform request deadline) and
+// RequestTimeout, whichever comes first. Internally this is a timerCtx:
+// a time.AfterFunc timer closes the context's done channel once
+// RequestTimeout elapses, the same cancellation path r.Context() itself
+// uses when the client goes away.
+func WithDeadline(c context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c, RequestTimeout)
+}
@@ -0,0 +1,186 @@
+package main
+
+// This file replaces the bare log.Printf calls in BeatChampion and
+// RenameChampion with structured JSON log lines, tags every request
+// with an ID via RequestIDMiddleware, and exposes /healthz and
+// /metrics for basic ops visibility.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogRecord is a single structured log line, marshaled as JSON to
+// stdout. Fields are omitted when zero so a rename's log line isn't
+// cluttered with beat-only fields and vice versa.
+type LogRecord struct {
+	Time       time.Time `json:"ts"`
+	Level      string    `json:"level"`
+	Message    string    `json:"msg"`
+	RequestID  string    `json:"request_id,omitempty"`
+	RemoteIP   string    `json:"remote_ip,omitempty"`
+	Score      int       `json:"score,omitempty"`
+	PrevScore  int       `json:"prev_score,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	DurationMs float64   `json:"duration_ms,omitempty"`
+	LatencyMs  float64   `json:"latency_ms,omitempty"`
+}
+
+func (r LogRecord) write() {
+	r.Time = time.Now()
+	data, err := json.Marshal(r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, `{"level":"error","msg":"failed to marshal log record: %v"}`+"\n", err)
+		return
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
+
+// LogInfo emits an "info" record, filling request_id/remote_ip from c
+// when RequestIDMiddleware set them.
+func LogInfo(c context.Context, msg string, fields LogRecord) {
+	fields.Level = "info"
+	fields.Message = msg
+	fields.RequestID = RequestIDFromContext(c)
+	fields.RemoteIP = RemoteIPFromContext(c)
+	fields.write()
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	remoteIPKey
+)
+
+// RequestIDFromContext returns the ID RequestIDMiddleware assigned to
+// this request, or "" outside of a request.
+func RequestIDFromContext(c context.Context) string {
+	id, _ := c.Value(requestIDKey).(string)
+	return id
+}
+
+// RemoteIPFromContext returns the client IP RequestIDMiddleware
+// resolved for this request, or "" outside of a request.
+func RemoteIPFromContext(c context.Context) string {
+	ip, _ := c.Value(remoteIPKey).(string)
+	return ip
+}
+
+var requestSeq uint64
+
+// NextRequestID mints a small, process-unique request ID; it only needs
+// to correlate the handful of log lines one request produces, not be
+// globally unique.
+func NextRequestID() string {
+	return strconv.FormatUint(atomic.AddUint64(&requestSeq, 1), 36)
+}
+
+// RequestIDMiddleware tags each request with an ID and its resolved
+// client IP, both reachable from handlers via r.Context().
+func RequestIDMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := r.Context()
+		c = context.WithValue(c, requestIDKey, NextRequestID())
+		c = context.WithValue(c, remoteIPKey, ClientIP(r))
+		next(w, r.WithContext(c))
+	}
+}
+
+// Histogram is a minimal Prometheus-style histogram: fixed buckets plus
+// a running sum and count, each bucket holding the count of
+// observations less than or equal to its bound.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sum += v
+	h.count++
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+}
+
+func (h *Histogram) writeProm(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// serverMetrics are the process-wide counters exposed at /metrics.
+type serverMetrics struct {
+	BeatAttempts       uint64
+	BeatSuccesses      uint64
+	RenameAttempts     uint64
+	RenameUnauthorized uint64
+	StoreLatency       *Histogram
+}
+
+// Metrics is the process-wide metrics instance updated by BeatChampion
+// and RenameChampion and read back by HandleMetrics.
+var Metrics = &serverMetrics{
+	StoreLatency: NewHistogram([]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}),
+}
+
+// ObserveStoreLatency times a store call for the StoreLatency histogram.
+func ObserveStoreLatency(start time.Time) {
+	Metrics.StoreLatency.Observe(time.Since(start).Seconds())
+}
+
+// A handler for "GET /healthz": a bare liveness check for uptime
+// checks/load balancers, not for clients of the game API.
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// A handler for "GET /metrics" in Prometheus text exposition format.
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP subleerunker_beat_attempts_total Score submissions received.\n")
+	fmt.Fprintf(w, "# TYPE subleerunker_beat_attempts_total counter\n")
+	fmt.Fprintf(w, "subleerunker_beat_attempts_total %d\n", atomic.LoadUint64(&Metrics.BeatAttempts))
+
+	fmt.Fprintf(w, "# HELP subleerunker_beat_successes_total Score submissions accepted.\n")
+	fmt.Fprintf(w, "# TYPE subleerunker_beat_successes_total counter\n")
+	fmt.Fprintf(w, "subleerunker_beat_successes_total %d\n", atomic.LoadUint64(&Metrics.BeatSuccesses))
+
+	fmt.Fprintf(w, "# HELP subleerunker_rename_attempts_total Rename requests received.\n")
+	fmt.Fprintf(w, "# TYPE subleerunker_rename_attempts_total counter\n")
+	fmt.Fprintf(w, "subleerunker_rename_attempts_total %d\n", atomic.LoadUint64(&Metrics.RenameAttempts))
+
+	fmt.Fprintf(w, "# HELP subleerunker_rename_unauthorized_total Rename requests rejected for a bad token.\n")
+	fmt.Fprintf(w, "# TYPE subleerunker_rename_unauthorized_total counter\n")
+	fmt.Fprintf(w, "subleerunker_rename_unauthorized_total %d\n", atomic.LoadUint64(&Metrics.RenameUnauthorized))
+
+	fmt.Fprintf(w, "# HELP subleerunker_store_latency_seconds Store operation latency.\n")
+	fmt.Fprintf(w, "# TYPE subleerunker_store_latency_seconds histogram\n")
+	Metrics.StoreLatency.writeProm(w, "subleerunker_store_latency_seconds")
+}
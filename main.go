@@ -13,18 +13,35 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
-import (
-	"cloud.google.com/go/datastore"
-	 "google.golang.org/api/iterator"
-)
+
+// store is the ChampionStore backend in use for this process. main()
+// populates it via NewChampionStore before serving any requests; it is
+// left nil at package init so that importing this package (as `go test`
+// does) never dials Datastore. Tests assign their own store directly.
+var store ChampionStore
+
+// replayVerifier checks that a submitted score was actually earned
+// before BeatChampion writes it to the store.
+var replayVerifier ReplayVerifier = &DefaultReplayVerifier{Seeds: replaySeeds}
 
 const TTL time.Duration = 7 * 24 * time.Hour // 7 days
 
+// MaxLeaderboardSize is how many non-expired scores are kept around.  A
+// submitted score is rejected unless it beats the lowest of these.
+const MaxLeaderboardSize = 100
+
+// DefaultLeaderboardLimit is the page size used by GET /leaderboard when
+// the caller does not pass its own "limit".
+const DefaultLeaderboardLimit = 10
+
 type Champion struct {
 	Score      int
 	Name       string
@@ -46,14 +63,14 @@ func (c *Champion) IsExpired(t time.Time) bool {
 var NoChampion = &Champion{0, "", "", 0, time.Time{}, 0, ""}
 
 type NotHigherScore struct {
-	Score     int
-	PrevScore int
+	Score      int
+	FloorScore int
 }
 
 func (n *NotHigherScore) Error() string {
 	return fmt.Sprintf(
-		"score %d is not higher than prev score %d",
-		n.Score, n.PrevScore,
+		"score %d is not higher than the leaderboard floor %d",
+		n.Score, n.FloorScore,
 	)
 }
 
@@ -81,45 +98,35 @@ func WriteResult(w http.ResponseWriter, result interface{}) {
 	w.Write(output)
 }
 
-func ConnectDatastore(c context.Context) *datastore.Client {
-	client, err := datastore.NewClient(c, "subleerunker-166907")
-	if err != nil {
-		log.Fatalf("Failed to create Cloud Datastore client: %v", err)
-	}
-	return client
+// Loads up to `limit` non-expired scores from the store, ordered by score
+// descending and, for ties, by RecordedAt ascending (the earlier
+// submission ranks higher). `offset` skips that many leading entries, so
+// pages are stable across calls as long as the leaderboard doesn't
+// change underneath.
+func LoadChampions(c context.Context, t time.Time, ttl time.Duration, limit, offset int) ([]*Champion, []StoreKey, error) {
+	return store.Load(c, t, ttl, limit, offset)
 }
 
-// Loads the current best score from the Google Cloud Datastore.
-// Returns (score, name, authorized, err).
-func LoadChampion(c context.Context, t time.Time, ttl time.Duration) (*Champion, *datastore.Key, error) {
-	root := datastore.NameKey("champions", "_", nil)
-	query := datastore.NewQuery("champion").Ancestor(root).
-		Filter("RecordedAt >", t.Add(-ttl)).
-		Order("-RecordedAt").Limit(10)
-
-	ds := ConnectDatastore(c)
-	defer ds.Close()
-
-	for i := ds.Run(c, query); ; {
-		var champion Champion
-		key, err := i.Next(&champion)
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return NoChampion, nil, err
-		} else if champion.IsExpired(t) {
-			continue
-		} else {
-			return &champion, key, nil
-		}
+// Loads the current reigning champion, i.e. the single best non-expired
+// score. Returns NoChampion when the leaderboard is empty.
+func LoadChampion(c context.Context, t time.Time, ttl time.Duration) (*Champion, StoreKey, error) {
+	return store.LoadTop(c, t, ttl, 0)
+}
+
+// Loads the lowest score currently ranked inside the top
+// MaxLeaderboardSize, i.e. the bar a new score has to clear.
+func LoadLeaderboardFloor(c context.Context, t time.Time, ttl time.Duration) (*Champion, error) {
+	champion, _, err := store.LoadTop(c, t, ttl, MaxLeaderboardSize-1)
+	if err != nil {
+		return nil, err
 	}
-	return NoChampion, nil, nil
+	return champion, nil
 }
 
 // A handler for "GET /champion".
 func GetChampion(w http.ResponseWriter, r *http.Request) {
-	c := r.Context()
+	c, cancel := WithDeadline(r.Context())
+	defer cancel()
 	champion, _, err := LoadChampion(c, time.Now(), TTL)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -175,7 +182,8 @@ func SuggestName(r *rand.Rand) string {
 
 // A handler for "PUT /champion" to beat the previous record.
 func BeatChampion(w http.ResponseWriter, r *http.Request) {
-	c := r.Context()
+	c, cancel := WithDeadline(r.Context())
+	defer cancel()
 
 	score, err := strconv.Atoi(r.FormValue("score"))
 	if err != nil {
@@ -198,10 +206,16 @@ func BeatChampion(w http.ResponseWriter, r *http.Request) {
 
 	replay := r.FormValue("replay")
 
-	log.Printf(
-		"Trying to beat champion: %d by '%s' in %.3f sec",
-		score, name, duration,
-	)
+	atomic.AddUint64(&Metrics.BeatAttempts, 1)
+	LogInfo(c, "Trying to beat champion", LogRecord{
+		Score: score, Name: name, DurationMs: duration * 1000,
+	})
+
+	durationValue := time.Duration(duration * float64(time.Second))
+	if err := replayVerifier.Verify(replay, score, durationValue); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	t := time.Now()
 	token := IssueToken(t.Unix())
@@ -209,7 +223,7 @@ func BeatChampion(w http.ResponseWriter, r *http.Request) {
 		Score:      score,
 		Name:       name,
 		Replay:     replay,
-		Duration:   time.Duration(duration * float64(time.Second)),
+		Duration:   durationValue,
 		RecordedAt: t,
 		ExpiresIn:  TTL,
 		Token:      token,
@@ -218,50 +232,60 @@ func BeatChampion(w http.ResponseWriter, r *http.Request) {
 	var prevScore int
 	var prevName string
 
-	ds := ConnectDatastore(c)
-	defer ds.Close()
-
-	_, err = ds.RunInTransaction(c, func(tx *datastore.Transaction) error {
-		prevChampion, _, err := LoadChampion(c, t, TTL)
+	storeStart := time.Now()
+	err = store.RunInTransaction(c, func(tx ChampionStore) error {
+		prevChampion, _, err := tx.LoadTop(c, t, TTL, 0)
 		if err != nil {
 			return err
 		}
-
 		prevScore = prevChampion.Score
 		prevName = prevChampion.Name
 
-		if score <= prevScore {
+		floor, _, err := tx.LoadTop(c, t, TTL, MaxLeaderboardSize-1)
+		if err != nil {
+			return err
+		}
+		if score <= floor.Score {
 			return &NotHigherScore{
-				Score:     score,
-				PrevScore: prevScore,
+				Score:      score,
+				FloorScore: floor.Score,
 			}
 		}
 
-		root := datastore.NameKey("champions", "_", nil)
-		key := datastore.IncompleteKey("champions", root)
-
-		_, err = tx.Put(key, champion)
+		_, err = tx.Put(c, nil, champion)
 		return err
-	}, nil)
+	})
+	ObserveStoreLatency(storeStart)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf(
-		"Champion has been beaten: %d by '%s' -> %d by '%s' in %.3f sec",
-		prevScore, prevName, score, name, duration,
-	)
+	atomic.AddUint64(&Metrics.BeatSuccesses, 1)
+	if score > prevScore {
+		LogInfo(c, fmt.Sprintf("Champion has been beaten: '%s' -> '%s'", prevName, name), LogRecord{
+			Score: score, PrevScore: prevScore, Name: name, DurationMs: duration * 1000,
+			LatencyMs: float64(time.Since(storeStart).Milliseconds()),
+		})
+	} else {
+		LogInfo(c, "New leaderboard entry", LogRecord{
+			Score: score, Name: name, DurationMs: duration * 1000,
+			LatencyMs: float64(time.Since(storeStart).Milliseconds()),
+		})
+	}
 	WriteAuthorizedChampion(w, champion)
 }
 
 // A handler for "PUT /champion" to rename the current record.
 func RenameChampion(w http.ResponseWriter, r *http.Request) {
-	c := r.Context()
+	c, cancel := WithDeadline(r.Context())
+	defer cancel()
 
 	name := r.FormValue("name")
 	name = NormalizeName(name)
-	log.Printf("Trying to rename champion: '%s'", name)
+
+	atomic.AddUint64(&Metrics.RenameAttempts, 1)
+	LogInfo(c, "Trying to rename champion", LogRecord{Name: name})
 
 	_, token, _ := r.BasicAuth()
 
@@ -269,11 +293,9 @@ func RenameChampion(w http.ResponseWriter, r *http.Request) {
 	var _champion Champion
 	var prevName string
 
-	ds := ConnectDatastore(c)
-	defer ds.Close()
-
-	_, err := ds.RunInTransaction(c, func(tx *datastore.Transaction) error {
-		champion, key, err := LoadChampion(c, t, TTL)
+	storeStart := time.Now()
+	err := store.RunInTransaction(c, func(tx ChampionStore) error {
+		champion, key, err := tx.LoadTop(c, t, TTL, 0)
 		if err != nil {
 			return err
 		}
@@ -284,24 +306,92 @@ func RenameChampion(w http.ResponseWriter, r *http.Request) {
 		}
 		champion.Name = name
 
-		_, err = tx.Put(key, champion)
+		_, err = tx.Put(c, key, champion)
 		_champion = *champion
 		return err
-	}, nil)
+	})
+	ObserveStoreLatency(storeStart)
 	switch err.(type) {
 	case nil:
 		break
 	case *NotAuthorized:
+		atomic.AddUint64(&Metrics.RenameUnauthorized, 1)
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	default:
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Champion has been renamed: '%s' -> '%s'", prevName, name)
+	LogInfo(c, fmt.Sprintf("Champion has been renamed: '%s' -> '%s'", prevName, name), LogRecord{
+		Name: name, LatencyMs: float64(time.Since(storeStart).Milliseconds()),
+	})
 	WriteAuthorizedChampion(w, &_champion)
 }
 
+// A handler for "GET /leaderboard" returning the top scores in descending
+// order. Accepts "?limit=&offset=" query parameters for pagination; limit
+// defaults to DefaultLeaderboardLimit and is capped at MaxLeaderboardSize.
+func HandleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "https://sublee.github.io")
+	if strings.ToUpper(r.Method) == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		return
+	}
+	if strings.ToUpper(r.Method) != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := DefaultLeaderboardLimit
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit <= 0 || limit > MaxLeaderboardSize {
+		limit = MaxLeaderboardSize
+	}
+
+	offset := 0
+	if s := r.FormValue("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	c, cancel := WithDeadline(r.Context())
+	defer cancel()
+	champions, _, err := LoadChampions(c, time.Now(), TTL, limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]struct {
+		Score     int       `json:"score"`
+		Name      string    `json:"name"`
+		Replay    string    `json:"replay"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}, len(champions))
+	for i, champion := range champions {
+		entries[i].Score = champion.Score
+		entries[i].Name = champion.Name
+		entries[i].Replay = champion.Replay
+		entries[i].ExpiresAt = champion.ExpiresAt()
+	}
+	WriteResult(w, entries)
+}
+
 // A combined handler for every methods of "/champion".
 func HandleChampion(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "https://sublee.github.io")
@@ -314,8 +404,15 @@ func HandleChampion(w http.ResponseWriter, r *http.Request) {
 		GetChampion(w, r)
 	case "PUT":
 		if r.FormValue("score") != "" {
+			if !RateLimit(w, beatLimiter, ClientIP(r)) {
+				return
+			}
 			BeatChampion(w, r)
 		} else {
+			_, token, _ := r.BasicAuth()
+			if !RateLimit(w, renameLimiter, token) {
+				return
+			}
 			RenameChampion(w, r)
 		}
 	default:
@@ -324,13 +421,49 @@ func HandleChampion(w http.ResponseWriter, r *http.Request) {
 }
 
 func init() {
-	http.HandleFunc("/champion", HandleChampion)
+	http.HandleFunc("/champion", RequestIDMiddleware(HandleChampion))
+	http.HandleFunc("/leaderboard", HandleLeaderboard)
+	http.HandleFunc("/replay/seed", HandleReplaySeed)
+	http.HandleFunc("/healthz", HandleHealthz)
+	http.HandleFunc("/metrics", HandleMetrics)
 }
 
 func main() {
+	var err error
+	store, err = NewChampionStore(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to initialize store: %v", err)
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
+
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%s", port),
+		ReadTimeout:  envTimeout("SUBLEERUNKER_READ_TIMEOUT", 5*time.Second),
+		WriteTimeout: envTimeout("SUBLEERUNKER_WRITE_TIMEOUT", RequestTimeout+5*time.Second),
+		IdleTimeout:  envTimeout("SUBLEERUNKER_IDLE_TIMEOUT", 2*time.Minute),
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+
+		log.Printf("Shutting down: waiting for in-flight requests to finish")
+		c, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+		defer cancel()
+		if err := server.Shutdown(c); err != nil {
+			log.Printf("Graceful shutdown failed: %v", err)
+		}
+		close(shutdown)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("ListenAndServe: %v", err)
+	}
+	<-shutdown
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func putTestChampion(t *testing.T, score int, recordedAt time.Time, expiresIn time.Duration) {
+	t.Helper()
+	champion := &Champion{
+		Score:      score,
+		Name:       "ABC",
+		RecordedAt: recordedAt,
+		ExpiresIn:  expiresIn,
+	}
+	if _, err := store.Put(context.Background(), nil, champion); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+}
+
+// TestLoadLeaderboardFloorSkipsExpiredEntriesInOffsetWindow guards against
+// a regression where the floor lookup's offset was applied before
+// expired entries were filtered out: an expired entry ranked ahead of
+// the floor shifted every following rank down by one, so BeatChampion's
+// "reject only if below the Nth entry" check let in scores it should
+// have rejected.
+func TestLoadLeaderboardFloorSkipsExpiredEntriesInOffsetWindow(t *testing.T) {
+	orig := store
+	store = NewMemoryStore()
+	defer func() { store = orig }()
+
+	now := time.Now()
+
+	// A handful of already-expired entries, scored higher than every live
+	// entry, so an offset applied before filtering would count them as
+	// if they still occupied the leaderboard's top ranks.
+	for i := 0; i < 5; i++ {
+		putTestChampion(t, 100000+i, now.Add(-2*time.Hour), time.Hour)
+	}
+
+	// More live entries than fit on the leaderboard, with unique
+	// descending scores, so the true floor (the MaxLeaderboardSize-th
+	// live score) is unambiguous.
+	const liveCount = MaxLeaderboardSize + 5
+	for i := 0; i < liveCount; i++ {
+		putTestChampion(t, 1000-i, now, TTL)
+	}
+
+	floor, err := LoadLeaderboardFloor(context.Background(), now, TTL)
+	if err != nil {
+		t.Fatalf("LoadLeaderboardFloor: %v", err)
+	}
+	if want := 1000 - (MaxLeaderboardSize - 1); floor.Score != want {
+		t.Errorf("floor.Score = %d, want %d (expired entries shifted the rank)", floor.Score, want)
+	}
+}
+
+// TestLoadLeaderboardFloorEmpty guards NoChampion's zero score acting as
+// a floor of zero when the leaderboard hasn't filled up yet.
+func TestLoadLeaderboardFloorEmpty(t *testing.T) {
+	orig := store
+	store = NewMemoryStore()
+	defer func() { store = orig }()
+
+	floor, err := LoadLeaderboardFloor(context.Background(), time.Now(), TTL)
+	if err != nil {
+		t.Fatalf("LoadLeaderboardFloor: %v", err)
+	}
+	if floor.Score != NoChampion.Score {
+		t.Errorf("floor.Score = %d, want %d", floor.Score, NoChampion.Score)
+	}
+}
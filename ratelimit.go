@@ -0,0 +1,210 @@
+package main
+
+// This file throttles PUT /champion: submissions get keyed by client IP
+// and renames additionally get keyed by the rename token, since neither
+// path had any throttle before this.
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// beatLimiter throttles score submissions per client IP.
+var beatLimiter = NewKeyedRateLimiter(
+	envFloat("SUBLEERUNKER_RATE_LIMIT", 0.2), // one submission per 5s on average
+	envFloat("SUBLEERUNKER_RATE_BURST", 5),
+)
+
+// renameLimiter throttles renames per token, so a leaked or guessed
+// token can't be used to spam the rename path.
+var renameLimiter = NewKeyedRateLimiter(
+	envFloat("SUBLEERUNKER_RENAME_RATE_LIMIT", 0.1),
+	envFloat("SUBLEERUNKER_RENAME_RATE_BURST", 2),
+)
+
+// seedLimiter throttles /replay/seed per client IP. Minting a seed is
+// otherwise free and instant, which would let a client mint many,
+// simulate all of them locally, and submit only the one whose obstacle
+// layout best suits a score it didn't earn; this keeps that fishing
+// expedition slow enough to not be worth it.
+var seedLimiter = NewKeyedRateLimiter(
+	envFloat("SUBLEERUNKER_SEED_RATE_LIMIT", 0.2),
+	envFloat("SUBLEERUNKER_SEED_RATE_BURST", 5),
+)
+
+// trustProxyHeaders controls whether ClientIP trusts X-Forwarded-For. It
+// defaults to on, matching this server's App Engine/Cloud Run deploys,
+// where the platform proxy sets X-Forwarded-For itself and strips
+// anything a client sent. Set SUBLEERUNKER_TRUST_PROXY=0 when running
+// directly behind the internet, where the header is attacker-controlled
+// and keying the rate limiter on it lets an attacker rotate spoofed IPs
+// to bypass the limit and grow beatLimiter's bucket map without bound.
+var trustProxyHeaders = os.Getenv("SUBLEERUNKER_TRUST_PROXY") != "0"
+
+// bucketIdleTTL is how long a KeyedRateLimiter bucket may sit unused
+// before evictSweep reclaims it, so a stream of distinct keys (rotating
+// IPs, forged or otherwise) can't grow the bucket map without bound.
+const bucketIdleTTL = 10 * time.Minute
+
+func init() {
+	go beatLimiter.evictSweep(bucketIdleTTL)
+	go renameLimiter.evictSweep(bucketIdleTTL)
+	go seedLimiter.evictSweep(bucketIdleTTL)
+}
+
+func envFloat(key string, def float64) float64 {
+	s := os.Getenv(key)
+	if s == "" {
+		return def
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+// TokenBucket is a classic token-bucket rate limiter: it holds up to
+// `burst` tokens and refills at `rate` tokens per second; each Allow
+// call consumes one.
+type TokenBucket struct {
+	mu         sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func NewTokenBucket(rate, burst float64) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, lastRefill: time.Now()}
+}
+
+// Allow reports whether a token is available and, if so, consumes it.
+func (b *TokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(b.lastRefill).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.lastRefill = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RetryAfter estimates how long until the bucket has another token.
+func (b *TokenBucket) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens >= 1 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// IdleSince reports how long it has been since Allow last touched the
+// bucket, so KeyedRateLimiter.evictSweep can reclaim buckets nobody is
+// using anymore.
+func (b *TokenBucket) IdleSince(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.lastRefill)
+}
+
+// KeyedRateLimiter hands out a TokenBucket per key (client IP, rename
+// token, ...), all sharing the same rate/burst configuration.
+type KeyedRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*TokenBucket
+	rate    float64
+	burst   float64
+}
+
+func NewKeyedRateLimiter(rate, burst float64) *KeyedRateLimiter {
+	return &KeyedRateLimiter{buckets: make(map[string]*TokenBucket), rate: rate, burst: burst}
+}
+
+// evictSweep runs until the process exits, periodically dropping buckets
+// that have sat idle for longer than ttl. Without this, a stream of
+// distinct keys (e.g. an attacker rotating spoofed X-Forwarded-For
+// values) would grow buckets without bound.
+func (l *KeyedRateLimiter) evictSweep(ttl time.Duration) {
+	interval := ttl / 2
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		now := time.Now()
+		l.mu.Lock()
+		for key, bucket := range l.buckets {
+			if bucket.IdleSince(now) >= ttl {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Allow reports whether the request under `key` is allowed, and if not,
+// how long the caller should wait before retrying.
+func (l *KeyedRateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(l.rate, l.burst)
+		l.buckets[key] = bucket
+	}
+	l.mu.Unlock()
+
+	if bucket.Allow() {
+		return true, 0
+	}
+	return false, bucket.RetryAfter()
+}
+
+// ClientIP extracts the caller's address, preferring the first hop of
+// X-Forwarded-For when trustProxyHeaders is set (as set by App
+// Engine/Cloud Run's proxy, which overwrites rather than appends to any
+// client-supplied header) and falling back to RemoteAddr otherwise. A
+// direct connection must never trust the header: it's client-controlled,
+// and keying the rate limiter on it would let an attacker rotate forged
+// values to both dodge the limit and grow the bucket map.
+func ClientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			if i := strings.Index(fwd, ","); i >= 0 {
+				fwd = fwd[:i]
+			}
+			return strings.TrimSpace(fwd)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimit checks key against limiter and, if it's exhausted, writes a
+// 429 with a Retry-After header and reports false.
+func RateLimit(w http.ResponseWriter, limiter *KeyedRateLimiter, key string) bool {
+	allowed, retryAfter := limiter.Allow(key)
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,280 @@
+package main
+
+// This file re-simulates a submitted replay so BeatChampion can confirm
+// a score was actually earned instead of trusting whatever the client
+// sends. The replay field has been stored since the beginning but never
+// read back.
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayFrameRate is the frame rate replay frame indices are counted in.
+const ReplayFrameRate = 60
+
+// ReplayLanes is how many lanes obstacles and the player can occupy.
+const ReplayLanes = 3
+
+// ReplayObstacleGapFrames is the fixed spacing between obstacle spawns.
+const ReplayObstacleGapFrames = 30
+
+// MaxScorePerSecond caps how many obstacles a legitimate run can clear
+// per second of play. ReplayObstacleGapFrames already implies this cap;
+// checking it separately also rejects a replay that simply lies about
+// its own length.
+const MaxScorePerSecond = float64(ReplayFrameRate) / ReplayObstacleGapFrames
+
+// ReplayToleranceSeconds is how far a replay's simulated duration may
+// drift from the submitted `duration` before being rejected; a little
+// slack absorbs rounding in the client's elapsed-time clock.
+const ReplayToleranceSeconds = 0.25
+
+// ReplayInvalid is returned by a ReplayVerifier when a replay doesn't
+// reproduce the score or duration it was submitted with, or exceeds
+// physically plausible limits.
+type ReplayInvalid struct {
+	Reason string
+}
+
+func (r *ReplayInvalid) Error() string {
+	return fmt.Sprintf("replay invalid: %s", r.Reason)
+}
+
+// ReplayVerifier re-simulates a submitted replay and confirms that it
+// actually produces the claimed score and duration.
+type ReplayVerifier interface {
+	Verify(replay string, score int, duration time.Duration) error
+}
+
+// replayEvent is a single frame-indexed lane change.
+type replayEvent struct {
+	frame int
+	code  byte // 'L' or 'R'
+}
+
+// DefaultReplayVerifier re-simulates the obstacle-lane game a replay
+// describes: obstacles spawn in a random lane every
+// ReplayObstacleGapFrames frames, seeded by the replay's own RNG seed;
+// the player occupies whichever lane its last 'L'/'R' event left it in;
+// and each obstacle the player isn't standing in front of is worth one
+// point. This reproduces the client's spawn/scoring rule closely enough
+// to catch a score the submitted events and seed couldn't have earned.
+//
+// The seed itself must have come from Seeds: without that, a client
+// could pick any seed it likes and brute-force offline for one whose
+// obstacle lanes happen to dodge a stationary player, which would let
+// it submit a real score having made zero moves. Seeds.Consume rejects
+// anything it didn't mint, so the seed a replay is scored against is
+// unknown to the client until it asks for one and out of its control.
+type DefaultReplayVerifier struct {
+	Seeds *SeedMinter
+}
+
+// Verify implements ReplayVerifier.
+func (v *DefaultReplayVerifier) Verify(replay string, score int, duration time.Duration) error {
+	seed, events, lastFrame, err := parseReplay(replay)
+	if err != nil {
+		return &ReplayInvalid{Reason: err.Error()}
+	}
+
+	if !v.Seeds.Consume(seed) {
+		return &ReplayInvalid{Reason: "seed was not issued by /replay/seed, already used, or expired"}
+	}
+
+	simulatedDuration := time.Duration(float64(lastFrame) / ReplayFrameRate * float64(time.Second))
+	if drift := (duration - simulatedDuration).Seconds(); drift > ReplayToleranceSeconds || drift < -ReplayToleranceSeconds {
+		return &ReplayInvalid{Reason: fmt.Sprintf(
+			"duration %.3fs doesn't match replay length %.3fs",
+			duration.Seconds(), simulatedDuration.Seconds(),
+		)}
+	}
+
+	if duration.Seconds() > 0 && float64(score)/duration.Seconds() > MaxScorePerSecond+1e-9 {
+		return &ReplayInvalid{Reason: fmt.Sprintf(
+			"score %d in %.3fs exceeds the %.1f points/sec cap",
+			score, duration.Seconds(), MaxScorePerSecond,
+		)}
+	}
+
+	if simulated := simulateReplay(seed, events, lastFrame); simulated != score {
+		return &ReplayInvalid{Reason: fmt.Sprintf(
+			"replay produces score %d, not the submitted %d",
+			simulated, score,
+		)}
+	}
+	return nil
+}
+
+// parseReplay reads the compact "seed,frame:code,frame:code,..." format:
+// a decimal RNG seed followed by frame-indexed lane-change events, with
+// non-decreasing frame numbers.
+func parseReplay(replay string) (seed int64, events []replayEvent, lastFrame int, err error) {
+	parts := strings.Split(replay, ",")
+	if len(parts) == 0 || parts[0] == "" {
+		return 0, nil, 0, fmt.Errorf("empty replay")
+	}
+
+	seed, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("bad seed: %v", err)
+	}
+
+	for _, part := range parts[1:] {
+		fields := strings.SplitN(part, ":", 2)
+		if len(fields) != 2 || len(fields[1]) != 1 {
+			return 0, nil, 0, fmt.Errorf("bad event %q", part)
+		}
+		frame, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return 0, nil, 0, fmt.Errorf("bad event frame %q: %v", part, err)
+		}
+		code := fields[1][0]
+		if code != 'L' && code != 'R' {
+			return 0, nil, 0, fmt.Errorf("bad event code %q", part)
+		}
+		if frame < lastFrame {
+			return 0, nil, 0, fmt.Errorf("event frames must be non-decreasing")
+		}
+		events = append(events, replayEvent{frame, code})
+		lastFrame = frame
+	}
+	return seed, events, lastFrame, nil
+}
+
+// simulateReplay re-runs the obstacle-lane game and returns the score it
+// produces. See DefaultReplayVerifier for the model being simulated.
+func simulateReplay(seed int64, events []replayEvent, lastFrame int) int {
+	r := mathrand.New(mathrand.NewSource(seed))
+	lane := ReplayLanes / 2
+	score := 0
+	nextEvent := 0
+
+	for frame := 0; frame <= lastFrame; frame++ {
+		for nextEvent < len(events) && events[nextEvent].frame == frame {
+			switch events[nextEvent].code {
+			case 'L':
+				if lane > 0 {
+					lane--
+				}
+			case 'R':
+				if lane < ReplayLanes-1 {
+					lane++
+				}
+			}
+			nextEvent++
+		}
+		if frame > 0 && frame%ReplayObstacleGapFrames == 0 {
+			if obstacleLane := r.Intn(ReplayLanes); obstacleLane == lane {
+				break
+			}
+			score++
+		}
+	}
+	return score
+}
+
+// SeedMinterTTL is how long a minted seed stays redeemable. It needs to
+// comfortably outlast a real run (MaxLeaderboardSize-worthy scores take
+// tens of seconds, see MaxScorePerSecond) without staying valid so long
+// that an abandoned seed is worth holding onto for a future attempt.
+const SeedMinterTTL = 10 * time.Minute
+
+// SeedMinter hands out single-use RNG seeds for BeatChampion's replay
+// verification. A seed is only valid once: Consume removes it the first
+// time it's redeemed, whether or not the replay built from it turns out
+// to be genuine, so a seed can't be probed against more than one replay.
+type SeedMinter struct {
+	mu       sync.Mutex
+	mintedAt map[int64]time.Time
+}
+
+func NewSeedMinter() *SeedMinter {
+	return &SeedMinter{mintedAt: make(map[int64]time.Time)}
+}
+
+// Mint returns a cryptographically random seed unknown to the caller in
+// advance, and remembers it as outstanding.
+func (m *SeedMinter) Mint() (int64, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, fmt.Errorf("mint replay seed: %v", err)
+	}
+	seed := int64(binary.BigEndian.Uint64(buf[:]))
+
+	m.mu.Lock()
+	m.mintedAt[seed] = time.Now()
+	m.mu.Unlock()
+	return seed, nil
+}
+
+// Consume reports whether seed is an outstanding, unexpired seed this
+// minter issued, and removes it either way so it can't be redeemed
+// twice.
+func (m *SeedMinter) Consume(seed int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mintedAt, ok := m.mintedAt[seed]
+	delete(m.mintedAt, seed)
+	return ok && time.Since(mintedAt) <= SeedMinterTTL
+}
+
+// evictSweep runs until the process exits, dropping minted seeds that
+// were never redeemed within ttl, so an attacker minting seeds and
+// discarding the ones it doesn't like can't grow the map without bound.
+func (m *SeedMinter) evictSweep(ttl time.Duration) {
+	for range time.Tick(ttl) {
+		now := time.Now()
+		m.mu.Lock()
+		for seed, mintedAt := range m.mintedAt {
+			if now.Sub(mintedAt) > ttl {
+				delete(m.mintedAt, seed)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// replaySeeds mints the seeds DefaultReplayVerifier requires a replay to
+// have used.
+var replaySeeds = NewSeedMinter()
+
+func init() {
+	go replaySeeds.evictSweep(SeedMinterTTL)
+}
+
+// HandleReplaySeed is the handler for "GET /replay/seed". A client calls
+// this before starting a run and builds its replay's RNG around the
+// seed it gets back, which is what lets DefaultReplayVerifier trust the
+// replay's obstacle layout wasn't chosen by the client itself.
+func HandleReplaySeed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "https://sublee.github.io")
+	if strings.ToUpper(r.Method) == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		return
+	}
+	if strings.ToUpper(r.Method) != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !RateLimit(w, seedLimiter, ClientIP(r)) {
+		return
+	}
+
+	seed, err := replaySeeds.Mint()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteResult(w, struct {
+		Seed int64 `json:"seed"`
+	}{seed})
+}
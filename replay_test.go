@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// mintGenuineReplay mints a fresh seed and builds a replay string/score/
+// duration triple that DefaultReplayVerifier.Verify should accept: the
+// score and duration are derived by running the same simulation Verify
+// itself runs, the way a well-behaved client would.
+func mintGenuineReplay(t *testing.T, seeds *SeedMinter, lastFrame int) (replay string, score int, duration time.Duration) {
+	t.Helper()
+	seed, err := seeds.Mint()
+	if err != nil {
+		t.Fatalf("Mint: %v", err)
+	}
+	events := []replayEvent{{frame: lastFrame, code: 'L'}}
+	score = simulateReplay(seed, events, lastFrame)
+	duration = time.Duration(float64(lastFrame) / ReplayFrameRate * float64(time.Second))
+	replay = fmt.Sprintf("%d,%d:L", seed, lastFrame)
+	return replay, score, duration
+}
+
+func TestDefaultReplayVerifierAcceptsGenuineReplay(t *testing.T) {
+	verifier := &DefaultReplayVerifier{Seeds: NewSeedMinter()}
+	replay, score, duration := mintGenuineReplay(t, verifier.Seeds, 5*ReplayObstacleGapFrames)
+
+	if err := verifier.Verify(replay, score, duration); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
+
+func TestDefaultReplayVerifierRejectsUnknownSeed(t *testing.T) {
+	verifier := &DefaultReplayVerifier{Seeds: NewSeedMinter()}
+
+	// 424242 was never minted by verifier.Seeds, so no offline seed
+	// search should be able to produce a replay this accepts.
+	replay := "424242,30:L"
+	err := verifier.Verify(replay, 0, time.Duration(float64(30)/ReplayFrameRate*float64(time.Second)))
+	if _, ok := err.(*ReplayInvalid); !ok {
+		t.Errorf("Verify error = %v, want *ReplayInvalid for an unminted seed", err)
+	}
+}
+
+func TestDefaultReplayVerifierRejectsReusedSeed(t *testing.T) {
+	verifier := &DefaultReplayVerifier{Seeds: NewSeedMinter()}
+	replay, score, duration := mintGenuineReplay(t, verifier.Seeds, 3*ReplayObstacleGapFrames)
+
+	if err := verifier.Verify(replay, score, duration); err != nil {
+		t.Fatalf("first Verify: %v", err)
+	}
+	if err := verifier.Verify(replay, score, duration); err == nil {
+		t.Error("second Verify with the same seed succeeded, want it rejected as already consumed")
+	}
+}
+
+func TestDefaultReplayVerifierRejectsTamperedScore(t *testing.T) {
+	verifier := &DefaultReplayVerifier{Seeds: NewSeedMinter()}
+	replay, score, duration := mintGenuineReplay(t, verifier.Seeds, 4*ReplayObstacleGapFrames)
+
+	err := verifier.Verify(replay, score+1, duration)
+	if _, ok := err.(*ReplayInvalid); !ok {
+		t.Errorf("Verify error = %v, want *ReplayInvalid for a score the replay didn't earn", err)
+	}
+}
+
+func TestDefaultReplayVerifierRejectsScorePerSecondCap(t *testing.T) {
+	verifier := &DefaultReplayVerifier{Seeds: NewSeedMinter()}
+	seed, err := verifier.Seeds.Mint()
+	if err != nil {
+		t.Fatalf("Mint: %v", err)
+	}
+
+	// A single ReplayObstacleGapFrames-frame run can be worth at most one
+	// point; claiming far more than that per second of play is
+	// physically implausible regardless of what the seed simulates to.
+	lastFrame := ReplayObstacleGapFrames
+	duration := time.Duration(float64(lastFrame) / ReplayFrameRate * float64(time.Second))
+	replay := fmt.Sprintf("%d,%d:L", seed, lastFrame)
+
+	err = verifier.Verify(replay, 1000, duration)
+	if _, ok := err.(*ReplayInvalid); !ok {
+		t.Errorf("Verify error = %v, want *ReplayInvalid for exceeding the points/sec cap", err)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+// This file abstracts the persistence layer used by main.go. It was
+// split out of main.go so the Datastore-specific code living inside
+// LoadChampion, BeatChampion and RenameChampion could be swapped out for
+// a backend that doesn't need GCP, and so tests don't have to mock
+// cloud.google.com/go/datastore.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+import (
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// StoreKey identifies a Champion stored inside a ChampionStore. Each
+// backend has its own concrete type; callers should treat it as opaque
+// and round-trip whatever Load gave them back into Put unchanged.
+type StoreKey interface {
+	String() string
+}
+
+// ChampionStore is the backend that persists and queries champions.
+type ChampionStore interface {
+	// Load returns up to `limit` non-expired champions ordered by score
+	// descending, RecordedAt ascending as a tiebreaker, skipping the
+	// first `offset` entries.
+	Load(c context.Context, t time.Time, ttl time.Duration, limit, offset int) ([]*Champion, []StoreKey, error)
+
+	// LoadTop is a convenience for the single champion ranked `rank`
+	// (0-based) among the non-expired entries. It returns NoChampion,
+	// nil, nil when fewer than rank+1 champions exist.
+	LoadTop(c context.Context, t time.Time, ttl time.Duration, rank int) (*Champion, StoreKey, error)
+
+	// Put inserts champion when key is nil, or overwrites the entry at
+	// key otherwise, and returns the key the entry was stored under.
+	Put(c context.Context, key StoreKey, champion *Champion) (StoreKey, error)
+
+	// RunInTransaction runs f against a store view that is isolated
+	// from concurrent writers, the way *datastore.Client.RunInTransaction
+	// does. Backends without native transactions approximate this with
+	// a mutex held for the call's duration.
+	RunInTransaction(c context.Context, f func(tx ChampionStore) error) error
+}
+
+// NewChampionStore selects a ChampionStore backend from the
+// SUBLEERUNKER_STORE environment variable ("datastore", "memory" or
+// "bolt"). It defaults to "datastore" to match the historical behavior.
+// The caller decides how to react to a failure (main fails fast; a test
+// harness might fall back to memory).
+func NewChampionStore(c context.Context) (ChampionStore, error) {
+	switch os.Getenv("SUBLEERUNKER_STORE") {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "bolt":
+		path := os.Getenv("SUBLEERUNKER_STORE_PATH")
+		if path == "" {
+			path = "champions.json"
+		}
+		return NewFileStore(path)
+	default:
+		return NewDatastoreStore(c)
+	}
+}
+
+// DatastoreStore persists champions in Google Cloud Datastore, under the
+// ancestor key used historically: NameKey("champions", "_", nil).
+type DatastoreStore struct {
+	client *datastore.Client
+}
+
+func NewDatastoreStore(c context.Context) (*DatastoreStore, error) {
+	client, err := datastore.NewClient(c, "subleerunker-166907")
+	if err != nil {
+		return nil, fmt.Errorf("create Cloud Datastore client: %w", err)
+	}
+	return &DatastoreStore{client}, nil
+}
+
+func championsRoot() *datastore.Key {
+	return datastore.NameKey("champions", "_", nil)
+}
+
+// championsRawLimitSlack pads a raw Datastore query past the caller's
+// own offset+limit window, so entries that expired without ever being
+// evicted (nothing deletes them) can still be skipped without the
+// window coming up short.
+const championsRawLimitSlack = 2 * MaxLeaderboardSize
+
+// championsRawLimitCap bounds how many raw "champion" entities a single
+// query ever fetches, however large a caller's offset+limit gets. This
+// caps the read cost of a single Load: without it, a request for a deep
+// offset degenerates into draining the entire kind.
+const championsRawLimitCap = 10 * MaxLeaderboardSize
+
+func championsRawLimit(limit, offset int) int {
+	n := offset + limit + championsRawLimitSlack
+	if n > championsRawLimitCap {
+		n = championsRawLimitCap
+	}
+	return n
+}
+
+// championsQuery orders by -Score, RecordedAt only. It deliberately does
+// not filter on RecordedAt: Datastore requires a query's first sort order
+// to match any inequality-filtered property, and stacking a "RecordedAt >"
+// filter in front of an "-Score" order would make every query fail with
+// INVALID_ARGUMENT. Expiry and the TTL cutoff are applied in Go instead,
+// by runChampionsQuery, the same way MemoryStore.loadLocked does it.
+// championsRawLimit caps how many raw rows that costs, since this query
+// has no way to filter expired rows out before counting against it.
+//
+// This still needs a composite index (Score desc, RecordedAt asc) under
+// the "champion" kind ancestor query; see index.yaml.
+func championsQuery(limit, offset int) *datastore.Query {
+	return datastore.NewQuery("champion").Ancestor(championsRoot()).
+		Order("-Score").Order("RecordedAt").
+		Limit(championsRawLimit(limit, offset))
+}
+
+// runChampionsQuery drains it, drops expired and TTL-cutoff entries, and
+// only then applies offset/limit, so an expired entry inside the offset
+// window doesn't shift later ranks the way a Datastore-side Offset would.
+func runChampionsQuery(it *datastore.Iterator, t time.Time, ttl time.Duration, limit, offset int) ([]*Champion, []StoreKey, error) {
+	type entry struct {
+		champion *Champion
+		key      StoreKey
+	}
+	var entries []entry
+	for {
+		var champion Champion
+		key, err := it.Next(&champion)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if champion.IsExpired(t) || champion.RecordedAt.Before(t.Add(-ttl)) {
+			continue
+		}
+		entries = append(entries, entry{&champion, key})
+	}
+
+	if offset >= len(entries) {
+		return nil, nil, nil
+	}
+	entries = entries[offset:]
+	if limit >= 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+
+	champions := make([]*Champion, len(entries))
+	keys := make([]StoreKey, len(entries))
+	for i, e := range entries {
+		champions[i] = e.champion
+		keys[i] = e.key
+	}
+	return champions, keys, nil
+}
+
+func (s *DatastoreStore) Load(c context.Context, t time.Time, ttl time.Duration, limit, offset int) ([]*Champion, []StoreKey, error) {
+	return runChampionsQuery(s.client.Run(c, championsQuery(limit, offset)), t, ttl, limit, offset)
+}
+
+func (s *DatastoreStore) LoadTop(c context.Context, t time.Time, ttl time.Duration, rank int) (*Champion, StoreKey, error) {
+	champions, keys, err := s.Load(c, t, ttl, 1, rank)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(champions) == 0 {
+		return NoChampion, nil, nil
+	}
+	return champions[0], keys[0], nil
+}
+
+func (s *DatastoreStore) Put(c context.Context, key StoreKey, champion *Champion) (StoreKey, error) {
+	dsKey, _ := key.(*datastore.Key)
+	if dsKey == nil {
+		dsKey = datastore.IncompleteKey("champion", championsRoot())
+	}
+	return s.client.Put(c, dsKey, champion)
+}
+
+func (s *DatastoreStore) RunInTransaction(c context.Context, f func(tx ChampionStore) error) error {
+	_, err := s.client.RunInTransaction(c, func(tx *datastore.Transaction) error {
+		return f(&datastoreTxStore{client: s.client, tx: tx})
+	})
+	return err
+}
+
+// datastoreTxStore is the ChampionStore view handed to f() inside
+// DatastoreStore.RunInTransaction. Queries run against the
+// transaction's snapshot; writes are staged on the transaction.
+type datastoreTxStore struct {
+	client *datastore.Client
+	tx     *datastore.Transaction
+}
+
+func (s *datastoreTxStore) Load(c context.Context, t time.Time, ttl time.Duration, limit, offset int) ([]*Champion, []StoreKey, error) {
+	query := championsQuery(limit, offset).Transaction(s.tx)
+	return runChampionsQuery(s.client.Run(c, query), t, ttl, limit, offset)
+}
+
+func (s *datastoreTxStore) LoadTop(c context.Context, t time.Time, ttl time.Duration, rank int) (*Champion, StoreKey, error) {
+	champions, keys, err := s.Load(c, t, ttl, 1, rank)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(champions) == 0 {
+		return NoChampion, nil, nil
+	}
+	return champions[0], keys[0], nil
+}
+
+func (s *datastoreTxStore) Put(c context.Context, key StoreKey, champion *Champion) (StoreKey, error) {
+	dsKey, _ := key.(*datastore.Key)
+	if dsKey == nil {
+		dsKey = datastore.IncompleteKey("champion", championsRoot())
+	}
+	pending, err := s.tx.Put(dsKey, champion)
+	if err != nil {
+		return nil, err
+	}
+	if dsKey.Incomplete() {
+		return pendingStoreKey{pending}, nil
+	}
+	return dsKey, nil
+}
+
+func (s *datastoreTxStore) RunInTransaction(c context.Context, f func(tx ChampionStore) error) error {
+	return f(s)
+}
+
+// pendingStoreKey wraps a *datastore.PendingKey for a newly inserted
+// entry whose real key is only known once the transaction commits.
+// Nothing in this codebase needs that key before commit, so it is never
+// round-tripped back into Put.
+type pendingStoreKey struct {
+	pending *datastore.PendingKey
+}
+
+func (k pendingStoreKey) String() string {
+	return "pending"
+}
+
+// MemoryStore is an in-memory ChampionStore meant for tests; nothing is
+// persisted across restarts.
+type MemoryStore struct {
+	mu        sync.Mutex
+	champions map[int64]*Champion
+	nextID    int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{champions: make(map[int64]*Champion)}
+}
+
+type memoryKey int64
+
+func (k memoryKey) String() string {
+	return strconv.FormatInt(int64(k), 10)
+}
+
+func (s *MemoryStore) Load(c context.Context, t time.Time, ttl time.Duration, limit, offset int) ([]*Champion, []StoreKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadLocked(t, ttl, limit, offset)
+}
+
+func (s *MemoryStore) loadLocked(t time.Time, ttl time.Duration, limit, offset int) ([]*Champion, []StoreKey, error) {
+	type entry struct {
+		id       int64
+		champion Champion
+	}
+	var entries []entry
+	for id, champion := range s.champions {
+		if champion.IsExpired(t) || champion.RecordedAt.Before(t.Add(-ttl)) {
+			continue
+		}
+		entries = append(entries, entry{id, *champion})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].champion.Score != entries[j].champion.Score {
+			return entries[i].champion.Score > entries[j].champion.Score
+		}
+		return entries[i].champion.RecordedAt.Before(entries[j].champion.RecordedAt)
+	})
+
+	if offset >= len(entries) {
+		return nil, nil, nil
+	}
+	entries = entries[offset:]
+	if limit >= 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+
+	champions := make([]*Champion, len(entries))
+	keys := make([]StoreKey, len(entries))
+	for i, e := range entries {
+		champion := e.champion
+		champions[i] = &champion
+		keys[i] = memoryKey(e.id)
+	}
+	return champions, keys, nil
+}
+
+func (s *MemoryStore) LoadTop(c context.Context, t time.Time, ttl time.Duration, rank int) (*Champion, StoreKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadTopLocked(t, ttl, rank)
+}
+
+func (s *MemoryStore) loadTopLocked(t time.Time, ttl time.Duration, rank int) (*Champion, StoreKey, error) {
+	champions, keys, err := s.loadLocked(t, ttl, 1, rank)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(champions) == 0 {
+		return NoChampion, nil, nil
+	}
+	return champions[0], keys[0], nil
+}
+
+func (s *MemoryStore) Put(c context.Context, key StoreKey, champion *Champion) (StoreKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putLocked(key, champion)
+}
+
+func (s *MemoryStore) putLocked(key StoreKey, champion *Champion) (StoreKey, error) {
+	var id memoryKey
+	if key == nil {
+		s.nextID++
+		id = memoryKey(s.nextID)
+	} else {
+		var ok bool
+		id, ok = key.(memoryKey)
+		if !ok {
+			return nil, fmt.Errorf("memory store: unrecognized key %v", key)
+		}
+	}
+	stored := *champion
+	s.champions[int64(id)] = &stored
+	return id, nil
+}
+
+func (s *MemoryStore) RunInTransaction(c context.Context, f func(tx ChampionStore) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return f(&memoryTxStore{s})
+}
+
+// memoryTxStore is the ChampionStore view handed to f() inside
+// MemoryStore.RunInTransaction; it calls the *Locked helpers directly
+// since the outer mutex is already held.
+type memoryTxStore struct {
+	store *MemoryStore
+}
+
+func (s *memoryTxStore) Load(c context.Context, t time.Time, ttl time.Duration, limit, offset int) ([]*Champion, []StoreKey, error) {
+	return s.store.loadLocked(t, ttl, limit, offset)
+}
+
+func (s *memoryTxStore) LoadTop(c context.Context, t time.Time, ttl time.Duration, rank int) (*Champion, StoreKey, error) {
+	return s.store.loadTopLocked(t, ttl, rank)
+}
+
+func (s *memoryTxStore) Put(c context.Context, key StoreKey, champion *Champion) (StoreKey, error) {
+	return s.store.putLocked(key, champion)
+}
+
+func (s *memoryTxStore) RunInTransaction(c context.Context, f func(tx ChampionStore) error) error {
+	return f(s)
+}
+
+// FileStore persists champions as JSON in a single file guarded by a
+// mutex, so the server can run a single instance with no GCP dependency
+// at all. (A real BoltDB-backed store would pull in an external module,
+// which this tree has no go.mod to vendor; a JSON file serves the same
+// "local, no-GCP" goal with only the standard library.)
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+	mem  *MemoryStore
+}
+
+type fileRecord struct {
+	ID       int64
+	Champion Champion
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, mem: NewMemoryStore()}
+	if err := s.load(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var records []fileRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+	for _, record := range records {
+		champion := record.Champion
+		s.mem.champions[record.ID] = &champion
+		if record.ID > s.mem.nextID {
+			s.mem.nextID = record.ID
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) save() error {
+	var records []fileRecord
+	for id, champion := range s.mem.champions {
+		records = append(records, fileRecord{id, *champion})
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *FileStore) Load(c context.Context, t time.Time, ttl time.Duration, limit, offset int) ([]*Champion, []StoreKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mem.loadLocked(t, ttl, limit, offset)
+}
+
+func (s *FileStore) LoadTop(c context.Context, t time.Time, ttl time.Duration, rank int) (*Champion, StoreKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mem.loadTopLocked(t, ttl, rank)
+}
+
+func (s *FileStore) Put(c context.Context, key StoreKey, champion *Champion) (StoreKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	newKey, err := s.mem.putLocked(key, champion)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return newKey, nil
+}
+
+func (s *FileStore) RunInTransaction(c context.Context, f func(tx ChampionStore) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Snapshot the in-memory map so a failing f() can be rolled back; a
+	// Put inside f() writes straight through to s.mem (see fileTxStore.Put)
+	// and would otherwise leave the cache diverged from disk on error.
+	snapshot := make(map[int64]*Champion, len(s.mem.champions))
+	for id, champion := range s.mem.champions {
+		snapshot[id] = champion
+	}
+	snapshotNextID := s.mem.nextID
+
+	tx := &fileTxStore{store: s}
+	if err := f(tx); err != nil {
+		s.mem.champions = snapshot
+		s.mem.nextID = snapshotNextID
+		return err
+	}
+	if tx.dirty {
+		return s.save()
+	}
+	return nil
+}
+
+// fileTxStore is the ChampionStore view handed to f() inside
+// FileStore.RunInTransaction; writes land in the in-memory cache
+// immediately and get flushed to disk once after f() returns, or rolled
+// back by RunInTransaction if f() returns an error.
+type fileTxStore struct {
+	store *FileStore
+	dirty bool
+}
+
+func (s *fileTxStore) Load(c context.Context, t time.Time, ttl time.Duration, limit, offset int) ([]*Champion, []StoreKey, error) {
+	return s.store.mem.loadLocked(t, ttl, limit, offset)
+}
+
+func (s *fileTxStore) LoadTop(c context.Context, t time.Time, ttl time.Duration, rank int) (*Champion, StoreKey, error) {
+	return s.store.mem.loadTopLocked(t, ttl, rank)
+}
+
+func (s *fileTxStore) Put(c context.Context, key StoreKey, champion *Champion) (StoreKey, error) {
+	s.dirty = true
+	return s.store.mem.putLocked(key, champion)
+}
+
+func (s *fileTxStore) RunInTransaction(c context.Context, f func(tx ChampionStore) error) error {
+	return f(s)
+}